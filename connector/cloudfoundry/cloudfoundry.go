@@ -1,17 +1,24 @@
 package cloudfoundry
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -20,6 +27,24 @@ import (
 	"github.com/concourse/dex/pkg/log"
 )
 
+// defaultGroupFormat is used when Config.GroupFormat is unset. It is a
+// deliberate narrowing of what this connector used to emit: previously
+// getGroupsClaims produced up to six claim shapes per org/space (bare org
+// GUID, bare org name, bare space GUID, "spaceGUID:role", "org:space" and
+// "org:space:role"); this default keeps only the "org:space:role" shape.
+// Operators upgrading from a pre-allow-list version of this connector whose
+// authorization policy is keyed on any of the other five forms will see
+// those group claims disappear and MUST set GroupFormat (and GroupPrefix,
+// if needed) to restore the shape their policy expects before upgrading.
+const defaultGroupFormat = "{{.Org}}:{{.Space}}:{{.Role}}"
+
+var validRoles = map[string]bool{"developer": true, "auditor": true, "manager": true}
+
+// certReloadInterval is how often the client certificate file is stat'd to
+// detect an out-of-band rotation (e.g. a secret-mount update) in addition to
+// the explicit SIGHUP trigger.
+const certReloadInterval = time.Minute
+
 type cloudfoundryConnector struct {
 	clientID         string
 	clientSecret     string
@@ -30,12 +55,27 @@ type cloudfoundryConnector struct {
 	userInfoURL      string
 	httpClient       *http.Client
 	logger           log.Logger
+
+	allowedOrgs  map[string]bool
+	spaceFilters []SpaceFilter
+	allowedRoles map[string]bool
+	groupFormat  *template.Template
+	groupPrefix  string
+
+	certReloader *certReloader
 }
 
 type connectorData struct {
-	AccessToken string
+	AccessToken  string
+	RefreshToken string
 }
 
+var (
+	_ connector.CallbackConnector = (*cloudfoundryConnector)(nil)
+	_ connector.RefreshConnector  = (*cloudfoundryConnector)(nil)
+	_ io.Closer                   = (*cloudfoundryConnector)(nil)
+)
+
 type Config struct {
 	ClientID           string   `json:"clientID"`
 	ClientSecret       string   `json:"clientSecret"`
@@ -43,12 +83,182 @@ type Config struct {
 	APIURL             string   `json:"apiURL"`
 	RootCAs            []string `json:"rootCAs"`
 	InsecureSkipVerify bool     `json:"insecureSkipVerify"`
+
+	// ClientCert and ClientKey point to PEM files holding a client
+	// certificate/key pair presented to the Cloud Controller and UAA. The
+	// pair is reloaded on SIGHUP or when the ClientCert file's mtime changes;
+	// a change to the ClientKey file alone is not detected, see certReloader.
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+
+	// ClientCertData and ClientKeyData carry the same certificate/key pair
+	// inline as PEM text, for deployments that inject config rather than
+	// mounting files. These take precedence over ClientCert/ClientKey and
+	// are not reloaded, since there is no file to watch.
+	ClientCertData string `json:"clientCertData"`
+	ClientKeyData  string `json:"clientKeyData"`
+
+	// Orgs restricts group claims to the named orgs (by name or GUID).
+	// Empty means all orgs the user belongs to are considered.
+	Orgs []string `json:"orgs"`
+
+	// Spaces restricts group claims to the listed org/space pairs. An empty
+	// Org or Name in a filter matches any org/space respectively. Empty
+	// means all spaces are considered.
+	Spaces []SpaceFilter `json:"spaces"`
+
+	// Roles restricts which CF roles (developer, auditor, manager) are
+	// queried and emitted as group claims. Empty means all three.
+	Roles []string `json:"roles"`
+
+	// GroupFormat is a text/template string rendered once per org/space/role
+	// the user holds, with fields .Org, .Space, .Role and .GUID (the space
+	// GUID). Defaults to "{{.Org}}:{{.Space}}:{{.Role}}", which is narrower
+	// than the set of group claims this connector emitted before allow-listing
+	// was added; see defaultGroupFormat.
+	GroupFormat string `json:"groupFormat"`
+
+	// GroupPrefix is prepended to every rendered group claim.
+	GroupPrefix string `json:"groupPrefix"`
+}
+
+// SpaceFilter names a single org/space pair to allow through to group
+// claims. Either field may be left empty to match any org or space.
+type SpaceFilter struct {
+	Org  string `json:"org"`
+	Name string `json:"name"`
+}
+
+// certReloader keeps an in-memory client certificate fresh by re-reading it
+// from disk whenever the process receives SIGHUP or the file's mtime
+// changes, so long-lived dex processes pick up rotated certs without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   log.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	sigCh chan os.Signal
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newCertReloader(certFile, keyFile string, logger log.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		sigCh:    make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(r.sigCh, syscall.SIGHUP)
+	go r.watch()
+
+	return r, nil
+}
+
+// Close stops watching for SIGHUP and certificate-file rotation and waits
+// for the watch goroutine to exit. It must be called whenever the
+// certReloader's connector is discarded (e.g. the connector config is
+// replaced), otherwise the watch goroutine and its SIGHUP subscription
+// leak for the lifetime of the process.
+func (r *certReloader) Close() {
+	signal.Stop(r.sigCh)
+	close(r.stop)
+	<-r.done
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate/key pair: %v", err)
+	}
+
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat client certificate: %v", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+
+	return nil
 }
 
+func (r *certReloader) watch() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.sigCh:
+			if err := r.reload(); err != nil {
+				r.logger.Errorf("failed-to-reload-client-certificate-on-sighup", err)
+			}
+		case <-ticker.C:
+			info, err := os.Stat(r.certFile)
+			if err != nil {
+				r.logger.Errorf("failed-to-stat-client-certificate", err)
+				continue
+			}
+
+			r.mu.RLock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mu.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			if err := r.reload(); err != nil {
+				r.logger.Errorf("failed-to-reload-rotated-client-certificate", err)
+			}
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// ccRoot is the CC v3 API root response (`GET /`), used to discover the UAA
+// authorization endpoint instead of the now-deprecated v2 `/v2/info` probe.
+type ccRoot struct {
+	Links struct {
+		Login struct {
+			Href string `json:"href"`
+		} `json:"login"`
+	} `json:"links"`
+}
+
+// ccResponse is a CC v3 paginated list response.
 type ccResponse struct {
-	NextURL      string     `json:"next_url"`
-	Resources    []resource `json:"resources"`
-	TotalResults int        `json:"total_results"`
+	Pagination struct {
+		TotalResults int `json:"total_results"`
+		Next         struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []resource `json:"resources"`
 }
 
 type resource struct {
@@ -80,21 +290,67 @@ type org struct {
 func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error) {
 	var err error
 
+	allowedRoles := map[string]bool{}
+	for _, role := range c.Roles {
+		if !validRoles[role] {
+			return nil, fmt.Errorf("cloudfoundry: invalid role %q, must be one of developer, auditor, manager", role)
+		}
+		allowedRoles[role] = true
+	}
+
+	groupFormatStr := c.GroupFormat
+	if groupFormatStr == "" {
+		groupFormatStr = defaultGroupFormat
+	}
+
+	groupFormat, err := template.New("groupFormat").Parse(groupFormatStr)
+	if err != nil {
+		return nil, fmt.Errorf("cloudfoundry: invalid groupFormat: %v", err)
+	}
+
+	allowedOrgs := map[string]bool{}
+	for _, o := range c.Orgs {
+		allowedOrgs[o] = true
+	}
+
 	cloudfoundryConn := &cloudfoundryConnector{
 		clientID:     c.ClientID,
 		clientSecret: c.ClientSecret,
 		apiURL:       c.APIURL,
 		redirectURI:  c.RedirectURI,
 		logger:       logger,
+		allowedOrgs:  allowedOrgs,
+		spaceFilters: c.Spaces,
+		allowedRoles: allowedRoles,
+		groupFormat:  groupFormat,
+		groupPrefix:  c.GroupPrefix,
 	}
 
-	cloudfoundryConn.httpClient, err = newHTTPClient(c.RootCAs, c.InsecureSkipVerify)
+	cloudfoundryConn.httpClient, cloudfoundryConn.certReloader, err = newHTTPClient(c, logger)
 	if err != nil {
 		return nil, err
 	}
 
+	// From here on, any early return must close the cert reloader we just
+	// started, otherwise a discovery failure (CF/UAA unreachable, bad
+	// response, ...) leaks its watch goroutine and SIGHUP subscription the
+	// same way a later config reload would without Close.
+	opened := false
+	defer func() {
+		if !opened {
+			cloudfoundryConn.Close()
+		}
+	}()
+
+	ctx := context.Background()
+
 	apiURL := strings.TrimRight(c.APIURL, "/")
-	apiResp, err := cloudfoundryConn.httpClient.Get(fmt.Sprintf("%s/v2/info", apiURL))
+	apiReq, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	apiResp, err := cloudfoundryConn.httpClient.Do(apiReq)
 	if err != nil {
 		logger.Errorf("failed-to-send-request-to-cloud-controller-api", err)
 		return nil, err
@@ -108,24 +364,38 @@ func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error)
 		return nil, err
 	}
 
-	var apiResult map[string]interface{}
-	json.NewDecoder(apiResp.Body).Decode(&apiResult)
+	var root ccRoot
+	if err := json.NewDecoder(apiResp.Body).Decode(&root); err != nil {
+		logger.Errorf("failed-to-decode-response-from-api", err)
+		return nil, err
+	}
+
+	uaaURL := strings.TrimRight(root.Links.Login.Href, "/")
+	if uaaURL == "" {
+		err = errors.New("cloud controller API root response did not include a login link")
+		logger.Errorf("failed-to-discover-uaa-url", err)
+		return nil, err
+	}
 
-	uaaURL := strings.TrimRight(apiResult["authorization_endpoint"].(string), "/")
-	uaaResp, err := cloudfoundryConn.httpClient.Get(fmt.Sprintf("%s/.well-known/openid-configuration", uaaURL))
+	uaaReq, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/.well-known/openid-configuration", uaaURL), nil)
 	if err != nil {
-		logger.Errorf("failed-to-send-request-to-uaa-api", err)
 		return nil, err
 	}
 
-	if apiResp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("request failed with status %d", apiResp.StatusCode)
-		logger.Errorf("failed-to-get-well-known-config-response-from-api", err)
+	uaaResp, err := cloudfoundryConn.httpClient.Do(uaaReq)
+	if err != nil {
+		logger.Errorf("failed-to-send-request-to-uaa-api", err)
 		return nil, err
 	}
 
 	defer uaaResp.Body.Close()
 
+	if uaaResp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("request failed with status %d", uaaResp.StatusCode)
+		logger.Errorf("failed-to-get-well-known-config-response-from-api", err)
+		return nil, err
+	}
+
 	var uaaResult map[string]interface{}
 	err = json.NewDecoder(uaaResp.Body).Decode(&uaaResult)
 
@@ -138,24 +408,47 @@ func (c *Config) Open(id string, logger log.Logger) (connector.Connector, error)
 	cloudfoundryConn.authorizationURL, _ = uaaResult["authorization_endpoint"].(string)
 	cloudfoundryConn.userInfoURL, _ = uaaResult["userinfo_endpoint"].(string)
 
+	opened = true
+
 	return cloudfoundryConn, err
 }
 
-func newHTTPClient(rootCAs []string, insecureSkipVerify bool) (*http.Client, error) {
+// newHTTPClient builds the HTTP client used to talk to the Cloud Controller
+// and UAA. When a file-based client certificate is configured, it also
+// returns the certReloader backing it, so the caller can Close it when the
+// connector is discarded.
+func newHTTPClient(c *Config, logger log.Logger) (*http.Client, *certReloader, error) {
 	pool, err := x509.SystemCertPool()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tlsConfig := tls.Config{RootCAs: pool, InsecureSkipVerify: insecureSkipVerify}
-	for _, rootCA := range rootCAs {
+	tlsConfig := tls.Config{RootCAs: pool, InsecureSkipVerify: c.InsecureSkipVerify}
+	for _, rootCA := range c.RootCAs {
 		rootCABytes, err := os.ReadFile(rootCA)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read root-ca: %v", err)
+			return nil, nil, fmt.Errorf("failed to read root-ca: %v", err)
 		}
 		if !tlsConfig.RootCAs.AppendCertsFromPEM(rootCABytes) {
-			return nil, fmt.Errorf("no certs found in root CA file %q", rootCA)
+			return nil, nil, fmt.Errorf("no certs found in root CA file %q", rootCA)
+		}
+	}
+
+	var reloader *certReloader
+
+	switch {
+	case c.ClientCertData != "" || c.ClientKeyData != "":
+		cert, err := tls.X509KeyPair([]byte(c.ClientCertData), []byte(c.ClientKeyData))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse inline client certificate/key pair: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case c.ClientCert != "" || c.ClientKey != "":
+		reloader, err = newCertReloader(c.ClientCert, c.ClientKey, logger)
+		if err != nil {
+			return nil, nil, err
 		}
+		tlsConfig.GetClientCertificate = reloader.getCertificate
 	}
 
 	return &http.Client{
@@ -172,7 +465,20 @@ func newHTTPClient(rootCAs []string, insecureSkipVerify bool) (*http.Client, err
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
 		},
-	}, nil
+	}, reloader, nil
+}
+
+// Close stops the connector's background certificate-reload goroutine, if
+// one was started for a file-based client certificate. The server must call
+// this when a connector's config is replaced (dex reopens a new connector
+// on every config change), otherwise each reconfigure leaks the previous
+// connector's watch goroutine and SIGHUP subscription.
+func (c *cloudfoundryConnector) Close() error {
+	if c.certReloader != nil {
+		c.certReloader.Close()
+	}
+
+	return nil
 }
 
 func (c *cloudfoundryConnector) LoginURL(scopes connector.Scopes, callbackURL, state string) (string, error) {
@@ -180,19 +486,31 @@ func (c *cloudfoundryConnector) LoginURL(scopes connector.Scopes, callbackURL, s
 		return "", fmt.Errorf("expected callback URL %q did not match the URL in the config %q", callbackURL, c.redirectURI)
 	}
 
-	oauth2Config := &oauth2.Config{
+	oauth2Config := c.oauth2Config(scopes)
+
+	return oauth2Config.AuthCodeURL(state), nil
+}
+
+// oauth2Config builds the oauth2.Config used for both the initial
+// authorization code exchange and subsequent refreshes, requesting
+// offline_access whenever the caller asked for a refresh token.
+func (c *cloudfoundryConnector) oauth2Config(scopes connector.Scopes) *oauth2.Config {
+	oauth2Scopes := []string{"openid", "cloud_controller.read"}
+	if scopes.OfflineAccess {
+		oauth2Scopes = append(oauth2Scopes, "offline_access")
+	}
+
+	return &oauth2.Config{
 		ClientID:     c.clientID,
 		ClientSecret: c.clientSecret,
 		Endpoint:     oauth2.Endpoint{TokenURL: c.tokenURL, AuthURL: c.authorizationURL},
 		RedirectURL:  c.redirectURI,
-		Scopes:       []string{"openid", "cloud_controller.read"},
+		Scopes:       oauth2Scopes,
 	}
-
-	return oauth2Config.AuthCodeURL(state), nil
 }
 
-func fetchRoleSpaces(baseURL, path, role string, client *http.Client) ([]space, error) {
-	resources, err := fetchResources(baseURL, path, client)
+func fetchRoleSpaces(ctx context.Context, baseURL, path, role string, client *http.Client) ([]space, error) {
+	resources, err := fetchResources(ctx, baseURL, path, client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch resources: %v", err)
 	}
@@ -210,8 +528,8 @@ func fetchRoleSpaces(baseURL, path, role string, client *http.Client) ([]space,
 	return spaces, nil
 }
 
-func fetchOrgs(baseURL, path string, client *http.Client) ([]org, error) {
-	resources, err := fetchResources(baseURL, path, client)
+func fetchOrgs(ctx context.Context, baseURL, path string, client *http.Client) ([]org, error) {
+	resources, err := fetchResources(ctx, baseURL, path, client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch resources: %v", err)
 	}
@@ -227,68 +545,188 @@ func fetchOrgs(baseURL, path string, client *http.Client) ([]org, error) {
 	return orgs, nil
 }
 
-func fetchResources(baseURL, path string, client *http.Client) ([]resource, error) {
-	var (
-		resources []resource
-		url       string
-	)
+const (
+	// maxFetchPages caps how many pages fetchResources will walk for a
+	// single resource list, so a misbehaving API (or an infinite next-page
+	// loop) can't hang a login forever.
+	maxFetchPages = 500
 
-	for {
-		url = fmt.Sprintf("%s%s", baseURL, path)
+	// maxFetchRetries bounds the number of attempts fetchResources makes
+	// for a single page before giving up.
+	maxFetchRetries = 5
+)
+
+// fetchResources walks a CC v3 paginated resource list, following
+// `pagination.next.href` until exhausted or maxFetchPages is reached. Each
+// page request is retried with exponential backoff on 429/5xx responses,
+// honoring a Retry-After header when the API sends one, and is cancelled
+// promptly if ctx is done.
+func fetchResources(ctx context.Context, baseURL, path string, client *http.Client) ([]resource, error) {
+	var resources []resource
+
+	url := baseURL + path
+
+	for page := 0; url != ""; page++ {
+		if page >= maxFetchPages {
+			return nil, fmt.Errorf("exceeded maximum of %d pages while fetching %s", maxFetchPages, path)
+		}
+
+		response, err := fetchResourcePage(ctx, url, client)
+		if err != nil {
+			return nil, err
+		}
+
+		resources = append(resources, response.Resources...)
+		url = response.Pagination.Next.Href
+	}
+
+	return resources, nil
+}
+
+func fetchResourcePage(ctx context.Context, url string, client *http.Client) (*ccResponse, error) {
+	var lastErr error
 
-		resp, err := client.Get(url)
+	// skipBackoff is set when the previous iteration already waited out an
+	// explicit Retry-After delay, so the top-of-loop exponential backoff for
+	// the next attempt is not also applied on top of it.
+	skipBackoff := false
+
+	for attempt := 0; attempt < maxFetchRetries; attempt++ {
+		if attempt > 0 && !skipBackoff {
+			if err := sleep(ctx, backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		skipBackoff = false
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build request: %v", err)
+		}
+
+		resp, err := client.Do(req)
 		if err != nil {
 			return nil, fmt.Errorf("failed to execute request: %v", err)
 		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			lastErr = fmt.Errorf("unsuccessful status code %d", resp.StatusCode)
+
+			delay := retryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+
+			if delay > 0 {
+				if err := sleep(ctx, delay); err != nil {
+					return nil, err
+				}
+				skipBackoff = true
+			}
+
+			continue
+		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
 			return nil, fmt.Errorf("unsuccessful status code %d", resp.StatusCode)
 		}
 
-		response := ccResponse{}
-		err = json.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse spaces: %v", err)
+		var response ccResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %v", err)
 		}
 
-		resources = append(resources, response.Resources...)
+		return &response, nil
+	}
 
-		path = response.NextURL
-		if path == "" {
-			break
-		}
+	return nil, fmt.Errorf("giving up after %d attempts: %v", maxFetchRetries, lastErr)
+}
+
+// backoff returns an exponentially increasing delay for the given (1-based)
+// retry attempt, starting at 250ms and doubling each attempt, capped at 10
+// seconds. Attempt 0 (the first try) has no delay.
+func backoff(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
 	}
+	d := 250 * time.Millisecond
+	for i := 1; i < attempt && d < 10*time.Second; i++ {
+		d *= 2
+	}
+	if d > 10*time.Second {
+		return 10 * time.Second
+	}
+	return d
+}
 
-	return resources, nil
+// retryAfter parses a Retry-After header (either delay-seconds or an
+// HTTP-date) and returns the delay it names, or 0 if the header is absent
+// or unparseable.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
 }
 
-func getGroupsClaims(orgs []org, spaces []space) []string {
-	var (
-		orgMap       = map[string]string{}
-		orgSpaces    = map[string][]space{}
-		groupsClaims = map[string]bool{}
-	)
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	for _, org := range orgs {
-		orgMap[org.GUID] = org.Name
-		orgSpaces[org.Name] = []space{}
-		groupsClaims[org.GUID] = true
-		groupsClaims[org.Name] = true
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// groupClaimFields is the data made available to a GroupFormat template.
+type groupClaimFields struct {
+	Org   string
+	Space string
+	Role  string
+	GUID  string
+}
 
-	for _, space := range spaces {
-		orgName := orgMap[space.OrgGUID]
-		orgSpaces[orgName] = append(orgSpaces[orgName], space)
-		groupsClaims[space.GUID] = true
-		groupsClaims[fmt.Sprintf("%s:%s", space.GUID, space.Role)] = true
+// getGroupsClaims renders one group claim per org/space/role the user
+// holds, after applying the connector's org, space and role allow-lists.
+func (c *cloudfoundryConnector) getGroupsClaims(orgs []org, spaces []space) ([]string, error) {
+	orgsByGUID := make(map[string]org, len(orgs))
+	for _, o := range orgs {
+		if !c.orgAllowed(o) {
+			continue
+		}
+		orgsByGUID[o.GUID] = o
 	}
 
-	for orgName, spaces := range orgSpaces {
-		for _, space := range spaces {
-			groupsClaims[fmt.Sprintf("%s:%s", orgName, space.Name)] = true
-			groupsClaims[fmt.Sprintf("%s:%s:%s", orgName, space.Name, space.Role)] = true
+	groupsClaims := map[string]bool{}
+
+	for _, sp := range spaces {
+		o, ok := orgsByGUID[sp.OrgGUID]
+		if !ok || !c.spaceAllowed(o, sp) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		fields := groupClaimFields{Org: o.Name, Space: sp.Name, Role: sp.Role, GUID: sp.GUID}
+		if err := c.groupFormat.Execute(&buf, fields); err != nil {
+			return nil, fmt.Errorf("failed to render group claim: %v", err)
 		}
+
+		groupsClaims[c.groupPrefix+buf.String()] = true
 	}
 
 	groups := make([]string, 0, len(groupsClaims))
@@ -298,7 +736,46 @@ func getGroupsClaims(orgs []org, spaces []space) []string {
 
 	sort.Strings(groups)
 
-	return groups
+	return groups, nil
+}
+
+// orgAllowed reports whether org o passes the connector's Orgs allow-list,
+// matching on either org name or GUID. An empty allow-list permits all orgs.
+func (c *cloudfoundryConnector) orgAllowed(o org) bool {
+	if len(c.allowedOrgs) == 0 {
+		return true
+	}
+	return c.allowedOrgs[o.Name] || c.allowedOrgs[o.GUID]
+}
+
+// spaceAllowed reports whether space sp, in org o, passes the connector's
+// Spaces allow-list. A filter with an empty Org or Name matches any
+// org/space respectively. An empty allow-list permits all spaces.
+func (c *cloudfoundryConnector) spaceAllowed(o org, sp space) bool {
+	if len(c.spaceFilters) == 0 {
+		return true
+	}
+
+	for _, f := range c.spaceFilters {
+		if f.Org != "" && f.Org != o.Name && f.Org != o.GUID {
+			continue
+		}
+		if f.Name != "" && f.Name != sp.Name {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+// roleAllowed reports whether role passes the connector's Roles allow-list.
+// An empty allow-list permits all roles.
+func (c *cloudfoundryConnector) roleAllowed(role string) bool {
+	if len(c.allowedRoles) == 0 {
+		return true
+	}
+	return c.allowedRoles[role]
 }
 
 func (c *cloudfoundryConnector) HandleCallback(s connector.Scopes, r *http.Request) (identity connector.Identity, err error) {
@@ -307,13 +784,7 @@ func (c *cloudfoundryConnector) HandleCallback(s connector.Scopes, r *http.Reque
 		return identity, errors.New(q.Get("error_description"))
 	}
 
-	oauth2Config := &oauth2.Config{
-		ClientID:     c.clientID,
-		ClientSecret: c.clientSecret,
-		Endpoint:     oauth2.Endpoint{TokenURL: c.tokenURL, AuthURL: c.authorizationURL},
-		RedirectURL:  c.redirectURI,
-		Scopes:       []string{"openid", "cloud_controller.read"},
-	}
+	oauth2Config := c.oauth2Config(s)
 
 	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, c.httpClient)
 
@@ -324,21 +795,102 @@ func (c *cloudfoundryConnector) HandleCallback(s connector.Scopes, r *http.Reque
 
 	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
 
-	userInfoResp, err := client.Get(c.userInfoURL)
+	identity, err = c.fetchUserInfo(ctx, client)
+	if err != nil {
+		return identity, err
+	}
+
+	if s.Groups {
+		identity.Groups, err = c.fetchGroupsClaims(ctx, client, identity.UserID)
+		if err != nil {
+			return identity, err
+		}
+	}
+
+	if s.OfflineAccess {
+		identity.ConnectorData, err = marshalConnectorData(token)
+		if err != nil {
+			return identity, err
+		}
+	}
+
+	return identity, nil
+}
+
+// Refresh renews a stored identity for a client that authenticated with the
+// offline_access scope. It exchanges the stored refresh token for a new
+// access token and, when group claims were requested, re-runs the org/space
+// fetch pipeline so the caller's groups stay current.
+func (c *cloudfoundryConnector) Refresh(ctx context.Context, s connector.Scopes, identity connector.Identity) (connector.Identity, error) {
+	var data connectorData
+	if err := json.Unmarshal(identity.ConnectorData, &data); err != nil {
+		return identity, fmt.Errorf("CF Connector: failed to unmarshal connector data: %v", err)
+	}
+
+	if data.RefreshToken == "" {
+		return identity, errors.New("CF Connector: no refresh token stored, re-authentication required")
+	}
+
+	oauth2Config := c.oauth2Config(s)
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient)
+
+	tokenSource := oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: data.RefreshToken})
+
+	token, err := tokenSource.Token()
+	if err != nil {
+		if rErr, ok := err.(*oauth2.RetrieveError); ok && strings.Contains(string(rErr.Body), "invalid_grant") {
+			return identity, fmt.Errorf("CF Connector: refresh token is no longer valid, re-authentication required: %v", err)
+		}
+		return identity, fmt.Errorf("CF Connector: failed to refresh token: %v", err)
+	}
+
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+
+	refreshed, err := c.fetchUserInfo(ctx, client)
+	if err != nil {
+		return identity, err
+	}
+
+	if s.Groups {
+		refreshed.Groups, err = c.fetchGroupsClaims(ctx, client, refreshed.UserID)
+		if err != nil {
+			return identity, err
+		}
+	}
+
+	if token.RefreshToken == "" {
+		token.RefreshToken = data.RefreshToken
+	}
+
+	refreshed.ConnectorData, err = marshalConnectorData(token)
+	if err != nil {
+		return identity, err
+	}
+
+	return refreshed, nil
+}
+
+func (c *cloudfoundryConnector) fetchUserInfo(ctx context.Context, client *http.Client) (connector.Identity, error) {
+	var identity connector.Identity
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.userInfoURL, nil)
+	if err != nil {
+		return identity, fmt.Errorf("CF Connector: failed to build request to userinfo: %v", err)
+	}
+
+	userInfoResp, err := client.Do(req)
 	if err != nil {
 		return identity, fmt.Errorf("CF Connector: failed to execute request to userinfo: %v", err)
 	}
+	defer userInfoResp.Body.Close()
 
 	if userInfoResp.StatusCode != http.StatusOK {
 		return identity, fmt.Errorf("CF Connector: failed to execute request to userinfo: status %d", userInfoResp.StatusCode)
 	}
 
-	defer userInfoResp.Body.Close()
-
 	var userInfoResult map[string]interface{}
-	err = json.NewDecoder(userInfoResp.Body).Decode(&userInfoResult)
-
-	if err != nil {
+	if err := json.NewDecoder(userInfoResp.Body).Decode(&userInfoResult); err != nil {
 		return identity, fmt.Errorf("CF Connector: failed to parse userinfo: %v", err)
 	}
 
@@ -348,47 +900,52 @@ func (c *cloudfoundryConnector) HandleCallback(s connector.Scopes, r *http.Reque
 	identity.Email, _ = userInfoResult["email"].(string)
 	identity.EmailVerified, _ = userInfoResult["email_verified"].(bool)
 
-	var (
-		devPath     = fmt.Sprintf("/v3/users/%s/spaces", identity.UserID)
-		auditorPath = fmt.Sprintf("/v3/users/%s/audited_spaces", identity.UserID)
-		managerPath = fmt.Sprintf("/v3/users/%s/managed_spaces", identity.UserID)
-		orgsPath    = fmt.Sprintf("/v3/users/%s/organizations", identity.UserID)
-	)
+	return identity, nil
+}
 
-	if s.Groups {
-		orgs, err := fetchOrgs(c.apiURL, orgsPath, client)
-		if err != nil {
-			return identity, fmt.Errorf("failed to fetch organizaitons: %v", err)
-		}
+// rolePaths maps each CF role this connector understands to the v3 user
+// endpoint that lists the spaces held under that role.
+var rolePaths = []struct {
+	role string
+	path string
+}{
+	{"developer", "/v3/users/%s/spaces"},
+	{"auditor", "/v3/users/%s/audited_spaces"},
+	{"manager", "/v3/users/%s/managed_spaces"},
+}
 
-		developerSpaces, err := fetchRoleSpaces(c.apiURL, devPath, "developer", client)
-		if err != nil {
-			return identity, fmt.Errorf("failed to fetch spaces for developer roles: %v", err)
-		}
+func (c *cloudfoundryConnector) fetchGroupsClaims(ctx context.Context, client *http.Client, userID string) ([]string, error) {
+	orgsPath := fmt.Sprintf("/v3/users/%s/organizations", userID)
 
-		auditorSpaces, err := fetchRoleSpaces(c.apiURL, auditorPath, "auditor", client)
-		if err != nil {
-			return identity, fmt.Errorf("failed to fetch spaces for developer roles: %v", err)
+	orgs, err := fetchOrgs(ctx, c.apiURL, orgsPath, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch organizaitons: %v", err)
+	}
+
+	var spaces []space
+	for _, rp := range rolePaths {
+		if !c.roleAllowed(rp.role) {
+			continue
 		}
 
-		managerSpaces, err := fetchRoleSpaces(c.apiURL, managerPath, "manager", client)
+		roleSpaces, err := fetchRoleSpaces(ctx, c.apiURL, fmt.Sprintf(rp.path, userID), rp.role, client)
 		if err != nil {
-			return identity, fmt.Errorf("failed to fetch spaces for developer roles: %v", err)
+			return nil, fmt.Errorf("failed to fetch spaces for %s roles: %v", rp.role, err)
 		}
 
-		developerSpaces = append(developerSpaces, append(auditorSpaces, managerSpaces...)...)
-
-		identity.Groups = getGroupsClaims(orgs, developerSpaces)
+		spaces = append(spaces, roleSpaces...)
 	}
 
-	if s.OfflineAccess {
-		data := connectorData{AccessToken: token.AccessToken}
-		connData, err := json.Marshal(data)
-		if err != nil {
-			return identity, fmt.Errorf("CF Connector: failed to parse connector data for offline access: %v", err)
-		}
-		identity.ConnectorData = connData
+	return c.getGroupsClaims(orgs, spaces)
+}
+
+func marshalConnectorData(token *oauth2.Token) ([]byte, error) {
+	data := connectorData{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}
+
+	connData, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("CF Connector: failed to parse connector data for offline access: %v", err)
 	}
 
-	return identity, nil
+	return connData, nil
 }
@@ -0,0 +1,278 @@
+package cloudfoundry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 0},
+		{1, 250 * time.Millisecond},
+		{2, 500 * time.Millisecond},
+		{3, time.Second},
+		{100, 10 * time.Second}, // capped
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	future := time.Now().Add(30 * time.Second)
+
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{"empty", "", 0},
+		{"seconds", "5", 5 * time.Second},
+		{"zero seconds", "0", 0},
+		{"malformed", "not-a-number-or-date", 0},
+		{"http-date", future.UTC().Format(http.TimeFormat), 0}, // checked separately below
+	}
+
+	for _, tt := range tests {
+		if tt.name == "http-date" {
+			continue
+		}
+		if got := retryAfter(tt.header); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	// HTTP-date inputs are time-sensitive, so assert the delay is
+	// approximately right rather than exact.
+	got := retryAfter(future.UTC().Format(http.TimeFormat))
+	if got <= 0 || got > 31*time.Second {
+		t.Errorf("retryAfter(future HTTP-date) = %v, want a positive delay close to 30s", got)
+	}
+}
+
+func TestOrgAllowed(t *testing.T) {
+	acme := org{Name: "acme", GUID: "guid-acme"}
+
+	tests := []struct {
+		name        string
+		allowedOrgs map[string]bool
+		org         org
+		wantAllowed bool
+	}{
+		{"empty allow-list permits all", nil, acme, true},
+		{"matches by name", map[string]bool{"acme": true}, acme, true},
+		{"matches by guid", map[string]bool{"guid-acme": true}, acme, true},
+		{"no match", map[string]bool{"other": true}, acme, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cloudfoundryConnector{allowedOrgs: tt.allowedOrgs}
+			if got := c.orgAllowed(tt.org); got != tt.wantAllowed {
+				t.Errorf("orgAllowed(%+v) = %v, want %v", tt.org, got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestSpaceAllowed(t *testing.T) {
+	acme := org{Name: "acme", GUID: "guid-acme"}
+	prod := space{Name: "prod", GUID: "guid-prod"}
+
+	tests := []struct {
+		name        string
+		filters     []SpaceFilter
+		wantAllowed bool
+	}{
+		{"empty filter list permits all", nil, true},
+		{"org and name match", []SpaceFilter{{Org: "acme", Name: "prod"}}, true},
+		{"org matches, name empty matches any space", []SpaceFilter{{Org: "acme"}}, true},
+		{"name matches, org empty matches any org", []SpaceFilter{{Name: "prod"}}, true},
+		{"org guid matches", []SpaceFilter{{Org: "guid-acme", Name: "prod"}}, true},
+		{"org mismatch", []SpaceFilter{{Org: "other", Name: "prod"}}, false},
+		{"name mismatch", []SpaceFilter{{Org: "acme", Name: "staging"}}, false},
+		{"no filter matches", []SpaceFilter{{Org: "other"}, {Name: "staging"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cloudfoundryConnector{spaceFilters: tt.filters}
+			if got := c.spaceAllowed(acme, prod); got != tt.wantAllowed {
+				t.Errorf("spaceAllowed(%+v, %+v) = %v, want %v", acme, prod, got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestRoleAllowed(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowedRoles map[string]bool
+		role         string
+		wantAllowed  bool
+	}{
+		{"empty allow-list permits all", nil, "developer", true},
+		{"role in allow-list", map[string]bool{"developer": true}, "developer", true},
+		{"role not in allow-list", map[string]bool{"developer": true}, "auditor", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cloudfoundryConnector{allowedRoles: tt.allowedRoles}
+			if got := c.roleAllowed(tt.role); got != tt.wantAllowed {
+				t.Errorf("roleAllowed(%q) = %v, want %v", tt.role, got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestGetGroupsClaims(t *testing.T) {
+	orgs := []org{
+		{Name: "acme", GUID: "org-acme"},
+		{Name: "other", GUID: "org-other"},
+	}
+	spaces := []space{
+		{Name: "prod", GUID: "space-prod", OrgGUID: "org-acme", Role: "developer"},
+		{Name: "staging", GUID: "space-staging", OrgGUID: "org-acme", Role: "auditor"},
+		{Name: "prod", GUID: "space-other-prod", OrgGUID: "org-other", Role: "developer"},
+	}
+
+	tmpl := template.Must(template.New("groupFormat").Parse(defaultGroupFormat))
+
+	t.Run("default format, no filters", func(t *testing.T) {
+		c := &cloudfoundryConnector{groupFormat: tmpl}
+
+		got, err := c.getGroupsClaims(orgs, spaces)
+		if err != nil {
+			t.Fatalf("getGroupsClaims returned error: %v", err)
+		}
+
+		want := []string{
+			"acme:prod:developer",
+			"acme:staging:auditor",
+			"other:prod:developer",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("getGroupsClaims() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("org allow-list filters out a whole org", func(t *testing.T) {
+		c := &cloudfoundryConnector{
+			groupFormat: tmpl,
+			allowedOrgs: map[string]bool{"acme": true},
+		}
+
+		got, err := c.getGroupsClaims(orgs, spaces)
+		if err != nil {
+			t.Fatalf("getGroupsClaims returned error: %v", err)
+		}
+
+		want := []string{"acme:prod:developer", "acme:staging:auditor"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("getGroupsClaims() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("group prefix and custom template", func(t *testing.T) {
+		custom := template.Must(template.New("groupFormat").Parse("{{.Role}}/{{.GUID}}"))
+		c := &cloudfoundryConnector{groupFormat: custom, groupPrefix: "cf:"}
+
+		got, err := c.getGroupsClaims(orgs, spaces)
+		if err != nil {
+			t.Fatalf("getGroupsClaims returned error: %v", err)
+		}
+
+		want := []string{
+			"cf:developer/space-other-prod",
+			"cf:developer/space-prod",
+			"cf:auditor/space-staging",
+		}
+		// getGroupsClaims sorts its output, so sort the expectation too.
+		sortedWant := append([]string(nil), want...)
+		sort.Strings(sortedWant)
+
+		if !reflect.DeepEqual(got, sortedWant) {
+			t.Errorf("getGroupsClaims() = %v, want %v", got, sortedWant)
+		}
+	})
+}
+
+func TestFetchResourcePageRetryAfter(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Write([]byte(`{"resources":[{"metadata":{"guid":"org-1"}}]}`))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := fetchResourcePage(context.Background(), server.URL, server.Client())
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("fetchResourcePage returned error: %v", err)
+	}
+	if len(resp.Resources) != 1 || resp.Resources[0].Metadata.GUID != "org-1" {
+		t.Errorf("fetchResourcePage() = %+v, want one resource with guid org-1", resp)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("server received %d requests, want 2", got)
+	}
+
+	// Only the 1s Retry-After should have been honored. Before the fix, the
+	// loop also applied backoff(1) == 250ms on top, pushing elapsed past
+	// 1.25s; assert we stayed close to the bare Retry-After delay instead.
+	if elapsed >= 1200*time.Millisecond {
+		t.Errorf("fetchResourcePage took %v, want close to the 1s Retry-After delay with no added backoff", elapsed)
+	}
+}
+
+func TestFetchResourcesPagination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "", "1":
+			fmt.Fprintf(w, `{"pagination":{"next":{"href":"%s?page=2"}},"resources":[{"metadata":{"guid":"org-1"}}]}`, "http://"+r.Host)
+		case "2":
+			fmt.Fprint(w, `{"pagination":{"next":{"href":""}},"resources":[{"metadata":{"guid":"org-2"}}]}`)
+		default:
+			t.Errorf("unexpected page request: %s", r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	resources, err := fetchResources(context.Background(), server.URL, "/v3/organizations", server.Client())
+	if err != nil {
+		t.Fatalf("fetchResources returned error: %v", err)
+	}
+
+	var guids []string
+	for _, resource := range resources {
+		guids = append(guids, resource.Metadata.GUID)
+	}
+
+	want := []string{"org-1", "org-2"}
+	if !reflect.DeepEqual(guids, want) {
+		t.Errorf("fetchResources() guids = %v, want %v", guids, want)
+	}
+}